@@ -0,0 +1,304 @@
+package dockerVolumeRbd
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/*
+ * The docker volume plugin protocol has no room for operations beyond the
+ * VolumeDriver API (snapshot/protect/clone management, resize, ...), so
+ * those are exposed instead through a small companion HTTP admin listener
+ * that speaks plain JSON over its own socket. It reuses the same rbdDriver
+ * instance and locking as the VolumeDriver handlers.
+ */
+
+// AdminServeMux builds the http.ServeMux for the admin listener. Callers
+// (normally main) are responsible for choosing how it's exposed, e.g.
+// http.Serve(adminListener, d.AdminServeMux()).
+func (d *rbdDriver) AdminServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/RbdDockerAdmin.SnapshotCreate", d.handleSnapshotCreate)
+	mux.HandleFunc("/RbdDockerAdmin.SnapshotList", d.handleSnapshotList)
+	mux.HandleFunc("/RbdDockerAdmin.SnapshotProtect", d.handleSnapshotProtect)
+	mux.HandleFunc("/RbdDockerAdmin.SnapshotUnprotect", d.handleSnapshotUnprotect)
+	mux.HandleFunc("/RbdDockerAdmin.RemoveForce", d.handleRemoveForce)
+	mux.HandleFunc("/RbdDockerAdmin.Resize", d.handleResize)
+	return mux
+}
+
+type snapshotRequest struct {
+	Name     string `json:"Name"`     // volume (rbd image) name
+	Snapshot string `json:"Snapshot"` // snapshot name
+}
+
+type snapshotListResponse struct {
+	Snapshots []string `json:"Snapshots"`
+	Err       string   `json:"Err"`
+}
+
+type removeForceRequest struct {
+	Name                 string `json:"Name"`
+	ForceFlattenChildren bool   `json:"ForceFlattenChildren"`
+}
+
+type adminResponse struct {
+	Err string `json:"Err"`
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(adminResponse{Err: err.Error()})
+}
+
+func (d *rbdDriver) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(req.Name)
+	if err != nil || v.Name == "" {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotCreate Message=volume state not found", req.Name))
+		return
+	}
+
+	if err := d.connect(v.Pool); err != nil {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotCreate Message=unable to connect to ceph pool: %s", req.Name, err))
+		return
+	}
+	defer d.shutdown()
+
+	if err := d.createRbdSnapshot(v.Pool, v.Name, req.Snapshot); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	v.Snapshots = append(v.Snapshots, req.Snapshot)
+	if err := d.setVolume(v); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(adminResponse{})
+}
+
+func (d *rbdDriver) handleSnapshotList(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(req.Name)
+	if err != nil || v.Name == "" {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotList Message=volume state not found", req.Name))
+		return
+	}
+
+	if err := d.connect(v.Pool); err != nil {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotList Message=unable to connect to ceph pool: %s", req.Name, err))
+		return
+	}
+	defer d.shutdown()
+
+	err, snapshots := d.listRbdSnapshots(v.Pool, v.Name)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(snapshotListResponse{Snapshots: snapshots})
+}
+
+func (d *rbdDriver) handleSnapshotProtect(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(req.Name)
+	if err != nil || v.Name == "" {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotProtect Message=volume state not found", req.Name))
+		return
+	}
+
+	if err := d.connect(v.Pool); err != nil {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotProtect Message=unable to connect to ceph pool: %s", req.Name, err))
+		return
+	}
+	defer d.shutdown()
+
+	if err := d.protectRbdSnapshot(v.Pool, v.Name, req.Snapshot); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	v.Protected = append(v.Protected, req.Snapshot)
+	if err := d.setVolume(v); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(adminResponse{})
+}
+
+func (d *rbdDriver) handleSnapshotUnprotect(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(req.Name)
+	if err != nil || v.Name == "" {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotUnprotect Message=volume state not found", req.Name))
+		return
+	}
+
+	if err := d.connect(v.Pool); err != nil {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminSnapshotUnprotect Message=unable to connect to ceph pool: %s", req.Name, err))
+		return
+	}
+	defer d.shutdown()
+
+	if err := d.unprotectRbdSnapshot(v.Pool, v.Name, req.Snapshot); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	protected := v.Protected[:0]
+	for _, s := range v.Protected {
+		if s != req.Snapshot {
+			protected = append(protected, s)
+		}
+	}
+	v.Protected = protected
+	if err := d.setVolume(v); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(adminResponse{})
+}
+
+// handleRemoveForce is the only way to delete an image that still has
+// dependent clones: Remove refuses outright since the docker volume API's
+// RemoveRequest has no room for a force_flatten_children option.
+func (d *rbdDriver) handleRemoveForce(w http.ResponseWriter, r *http.Request) {
+	var req removeForceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(req.Name)
+	if err != nil || v.Name == "" {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminRemoveForce Message=volume state not found", req.Name))
+		return
+	}
+
+	err = d.connect(v.Pool)
+	if err != nil {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminRemoveForce Message=unable to connect to ceph pool: %s", req.Name, err))
+		return
+	}
+	defer d.shutdown()
+
+	if len(v.Children) > 0 {
+		if !req.ForceFlattenChildren {
+			writeAdminError(w, logError("volume-rbd Name=%s Request=AdminRemoveForce Message=image has dependent clones %v: pass ForceFlattenChildren=true", req.Name, v.Children))
+			return
+		}
+
+		for _, child := range v.Children {
+			if err := d.flattenRbdImage(v.Pool, child); err != nil {
+				writeAdminError(w, logError("volume-rbd Name=%s Request=AdminRemoveForce Message=unable to flatten child %s: %s", req.Name, child, err))
+				return
+			}
+
+			err, childVolume := d.getVolume(child)
+			if err != nil || childVolume.Name == "" {
+				writeAdminError(w, logError("volume-rbd Name=%s Request=AdminRemoveForce Message=unable to reload flattened child %s: %s", req.Name, child, err))
+				return
+			}
+			childVolume.ParentImage = ""
+			childVolume.ParentSnapshot = ""
+			if err := d.setVolume(childVolume); err != nil {
+				writeAdminError(w, logError("volume-rbd Name=%s Request=AdminRemoveForce Message=unable to save flattened child %s: %s", req.Name, child, err))
+				return
+			}
+		}
+		v.Children = nil
+	}
+
+	if err := d.removeRbdImageWithRetries(v.Name); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	if err := d.deleteVolume(v.Name); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	logrus.Infof("volume-rbd Name=%s Request=AdminRemoveForce Message=removed after flattening dependent clones", req.Name)
+	json.NewEncoder(w).Encode(adminResponse{})
+}
+
+type resizeRequest struct {
+	Name      string `json:"Name"`
+	NewSizeMB uint64 `json:"NewSizeMB"`
+	Shrink    bool   `json:"Shrink"`
+}
+
+func (d *rbdDriver) handleResize(w http.ResponseWriter, r *http.Request) {
+	var req resizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(req.Name)
+	if err != nil || v.Name == "" {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminResize Message=volume state not found", req.Name))
+		return
+	}
+
+	err = d.connect(v.Pool)
+	if err != nil {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminResize Message=unable to connect to ceph pool: %s", req.Name, err))
+		return
+	}
+	defer d.shutdown()
+
+	if err := d.resizeVolume(v, req.NewSizeMB, req.Shrink); err != nil {
+		writeAdminError(w, logError("volume-rbd Name=%s Request=AdminResize Message=%s", req.Name, err))
+		return
+	}
+
+	logrus.Infof("volume-rbd Name=%s Request=AdminResize Message=resized to %dMB", req.Name, req.NewSizeMB)
+	json.NewEncoder(w).Encode(adminResponse{})
+}
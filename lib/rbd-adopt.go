@@ -0,0 +1,123 @@
+package dockerVolumeRbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/*
+ * Support for Create against an rbd image that already exists, either
+ * because --opt adopt=true was passed explicitly or because an image named
+ * after the volume is already sitting in the pool. Rather than trust the
+ * Fstype/Size/Order defaults a brand new Volume would get, we recover the
+ * real values: first by consulting --opt metadata_pool=..., which holds a
+ * JSON blob per image for volumes an older version of this plugin (or
+ * something external) provisioned, and otherwise by probing the image and
+ * the filesystem on it directly.
+ */
+
+// legacyVolumeMetadata is the JSON shape stored (keyed by image name) in
+// --opt metadata_pool.
+type legacyVolumeMetadata struct {
+	Fstype string `json:"fstype"`
+	Size   uint64 `json:"size"`
+	Order  int    `json:"order"`
+}
+
+// adoptRbdImage populates v.Fstype, v.Size, and v.Order for an rbd image
+// that already exists, preferring a record in metadataPool (when given)
+// over probing the image itself.
+func (d *rbdDriver) adoptRbdImage(v *Volume, metadataPool string) error {
+	if metadataPool != "" {
+		meta, err := loadLegacyVolumeMetadata(metadataPool, v.Name)
+		if err != nil {
+			logrus.Warnf("volume-rbd Name=%s Request=Create Message=no usable record in metadata_pool=%s, falling back to probing image: %s", v.Name, metadataPool, err)
+		} else {
+			v.Fstype = meta.Fstype
+			v.Size = meta.Size
+			v.Order = meta.Order
+			logrus.Infof("volume-rbd Name=%s Request=Create Message=recovered volume state from metadata_pool=%s", v.Name, metadataPool)
+			return nil
+		}
+	}
+
+	fstype, size, order, err := d.probeRbdImage(v.Pool, v.Name)
+	if err != nil {
+		return err
+	}
+
+	v.Fstype = fstype
+	v.Size = size
+	v.Order = order
+	return nil
+}
+
+// loadLegacyVolumeMetadata fetches the JSON blob rados object named image
+// out of metadataPool and decodes it.
+func loadLegacyVolumeMetadata(metadataPool, image string) (*legacyVolumeMetadata, error) {
+	out, err := exec.Command("rados", "-p", metadataPool, "get", image, "-").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read metadata object %s from pool %s: %s", image, metadataPool, err)
+	}
+
+	var meta legacyVolumeMetadata
+	if err := json.Unmarshal(out, &meta); err != nil {
+		return nil, fmt.Errorf("unable to parse metadata object %s: %s", image, err)
+	}
+	return &meta, nil
+}
+
+// rbdImageInfo is the subset of `rbd info --format=json` we care about.
+type rbdImageInfo struct {
+	Size  uint64 `json:"size"` // bytes
+	Order int    `json:"order"`
+}
+
+// probeRbdImage recovers Fstype/Size/Order for an rbd image that already
+// exists by asking rbd for its size/object-order and briefly mapping it to
+// ask blkid for its filesystem type.
+func (d *rbdDriver) probeRbdImage(pool, image string) (string, uint64, int, error) {
+	out, err := d.rbdsh(pool, "info", image, "--format=json")
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("unable to query rbd image info: %s", err)
+	}
+
+	var info rbdImageInfo
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return "", 0, 0, fmt.Errorf("unable to parse rbd image info: %s", err)
+	}
+
+	fstype, err := d.probeRbdImageFstype(pool, image)
+	if err != nil {
+		logrus.Warnf("volume-rbd Name=%s Request=Create Message=unable to probe filesystem type, assuming ext4: %s", image, err)
+		fstype = "ext4"
+	}
+
+	return fstype, info.Size / (1024 * 1024), info.Order, nil
+}
+
+// probeRbdImageFstype briefly maps image to a kernel rbd device, asks
+// blkid for its filesystem type, and unmaps it again.
+func (d *rbdDriver) probeRbdImageFstype(pool, image string) (string, error) {
+	device, err := d.rbdsh(pool, "device", "map", image)
+	if err != nil {
+		return "", fmt.Errorf("unable to map image: %s", err)
+	}
+	device = strings.TrimSpace(device)
+	defer d.rbdsh(pool, "device", "unmap", device)
+
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", device).Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to blkid %s: %s", device, err)
+	}
+
+	fstype := strings.TrimSpace(string(out))
+	if fstype == "" {
+		return "", fmt.Errorf("blkid reported no filesystem type for %s", device)
+	}
+	return fstype, nil
+}
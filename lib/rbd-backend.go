@@ -0,0 +1,184 @@
+package dockerVolumeRbd
+
+import (
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+/*
+ * VolumeBackend lets rbdDriver proxy a volume request to something other
+ * than Ceph RBD. The built-in "rbd" backend is rbdDriver itself (see
+ * createRBD/removeRBD/mountRBD/unmountRBD/listRBD/getRBD); any other name is
+ * resolved to a docker volume plugin discovered on the host and forwarded
+ * over its plugin-helpers socket.
+ *
+ * Path and Capabilities aren't part of this interface: the mountpoint
+ * recorded in the shared Volume store is backend-agnostic, and capability
+ * negotiation only concerns docker itself, not the backend doing the work.
+ */
+type VolumeBackend interface {
+	Create(r *volume.CreateRequest) error
+	Remove(r *volume.RemoveRequest) error
+	Mount(r *volume.MountRequest) (*volume.MountResponse, error)
+	Unmount(r *volume.UnmountRequest) error
+	List() (*volume.ListResponse, error)
+	Get(r *volume.GetRequest) (*volume.GetResponse, error)
+}
+
+const defaultBackendName = "rbd"
+
+// rbdBackend adapts rbdDriver's own RBD-specific methods to VolumeBackend.
+type rbdBackend struct {
+	d *rbdDriver
+}
+
+func (b *rbdBackend) Create(r *volume.CreateRequest) error { return b.d.createRBD(r) }
+func (b *rbdBackend) Remove(r *volume.RemoveRequest) error { return b.d.removeRBD(r) }
+func (b *rbdBackend) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	return b.d.mountRBD(r)
+}
+func (b *rbdBackend) Unmount(r *volume.UnmountRequest) error                { return b.d.unmountRBD(r) }
+func (b *rbdBackend) List() (*volume.ListResponse, error)                   { return b.d.listRBD() }
+func (b *rbdBackend) Get(r *volume.GetRequest) (*volume.GetResponse, error) { return b.d.getRBD(r) }
+
+// backend returns the VolumeBackend registered under name, lazily
+// constructing a pluginProxyBackend for anything other than "rbd".
+//
+// Callers must hold d.Lock(): d.backends is driver state like everything
+// else guarded by it, and is read and lazily written here.
+func (d *rbdDriver) backend(name string) (VolumeBackend, error) {
+	if name == "" {
+		name = defaultBackendName
+	}
+
+	if d.backends == nil {
+		d.backends = map[string]VolumeBackend{}
+	}
+
+	if b, ok := d.backends[name]; ok {
+		return b, nil
+	}
+
+	var b VolumeBackend
+	if name == defaultBackendName {
+		b = &rbdBackend{d: d}
+	} else {
+		proxy, err := newPluginProxyBackend(d, name)
+		if err != nil {
+			return nil, err
+		}
+		b = proxy
+	}
+
+	d.backends[name] = b
+	return b, nil
+}
+
+// backendForVolume looks up which backend owns an already-created volume,
+// so Remove/Mount/Unmount/Get can be routed without the caller repeating
+// --opt backend=....
+func (d *rbdDriver) backendForVolume(name string) (VolumeBackend, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.Name == "" {
+		return nil, logError("volume-rbd Name=%s Message=volume state not found", name)
+	}
+
+	return d.backend(v.Backend)
+}
+
+/*
+ * Create dispatches to the backend named by --opt backend=... (defaulting
+ * to "rbd") and records which backend owns the volume.
+ *
+ * POST /VolumeDriver.Create
+ */
+func (d *rbdDriver) Create(r *volume.CreateRequest) error {
+	d.Lock()
+	b, err := d.backend(r.Options["backend"])
+	d.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.Create(r)
+}
+
+// POST /VolumeDriver.Remove
+func (d *rbdDriver) Remove(r *volume.RemoveRequest) error {
+	b, err := d.backendForVolume(r.Name)
+	if err != nil {
+		return err
+	}
+	return b.Remove(r)
+}
+
+// POST /VolumeDriver.Mount
+func (d *rbdDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	b, err := d.backendForVolume(r.Name)
+	if err != nil {
+		return &volume.MountResponse{}, err
+	}
+	return b.Mount(r)
+}
+
+// POST /VolumeDriver.Unmount
+func (d *rbdDriver) Unmount(r *volume.UnmountRequest) error {
+	b, err := d.backendForVolume(r.Name)
+	if err != nil {
+		return err
+	}
+	return b.Unmount(r)
+}
+
+// POST /VolumeDriver.Get
+func (d *rbdDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+	b, err := d.backendForVolume(r.Name)
+	if err != nil {
+		return &volume.GetResponse{}, err
+	}
+	return b.Get(r)
+}
+
+// POST /VolumeDriver.List aggregates every registered backend, since a
+// volume may have been created through any of them.
+func (d *rbdDriver) List() (*volume.ListResponse, error) {
+	rbdList, err := (&rbdBackend{d: d}).List()
+	if err != nil {
+		return rbdList, err
+	}
+
+	d.Lock()
+	err, volumes := d.getVolumes()
+	d.Unlock()
+	if err != nil {
+		return rbdList, err
+	}
+
+	seen := map[string]bool{}
+	for _, v := range rbdList.Volumes {
+		seen[v.Name] = true
+	}
+
+	for _, v := range *volumes {
+		if v.Backend == "" || v.Backend == defaultBackendName || seen[v.Name] {
+			continue
+		}
+		d.Lock()
+		b, err := d.backend(v.Backend)
+		d.Unlock()
+		if err != nil {
+			continue
+		}
+		resp, err := b.Get(&volume.GetRequest{Name: v.Name})
+		if err != nil {
+			continue
+		}
+		rbdList.Volumes = append(rbdList.Volumes, resp.Volume)
+	}
+
+	return rbdList, nil
+}
@@ -16,6 +16,22 @@ type Volume struct {
 	Order      int    // Specifies the object size expressed as a number of bits. The default is 22 (4KB).
 	Mountpoint string
 	Device     string
+	Backend    string // name of the VolumeBackend that owns this volume, e.g. "rbd"
+
+	UID                int    // chown the mountpoint root to this uid after mounting; -1 leaves ownership alone
+	GID                int    // chown the mountpoint root to this gid after mounting; -1 leaves ownership alone
+	Mode               string // chmod the mountpoint root to this octal mode (e.g. "0770") after mounting; "" leaves the mode alone
+	SELinuxLabel       string // SELinux context applied to the mountpoint via chcon; "" skips relabeling
+	SELinuxShared      bool   // selinux_label option suffix: "z" (true) shares the label across containers, "Z" (false) relabels it private to this one
+	NoChownIfPopulated bool   // skip the uid/gid chown when the mountpoint already contains files
+
+	Transport string // "krbd" or "nbd": which kernel client actually has this image mapped, so Unmount can use the matching tool
+
+	Snapshots      []string // names of snapshots taken against this image
+	Protected      []string // subset of Snapshots that are protected against removal
+	ParentImage    string   // set when this volume was cloned from a snapshot
+	ParentSnapshot string   // the snapshot this volume was cloned from
+	Children       []string // volumes cloned from a snapshot of this image
 }
 
 /*
@@ -45,7 +61,7 @@ type Volume struct {
  * Response error
  *
  */
-func (d *rbdDriver) Create(r *volume.CreateRequest) error {
+func (d *rbdDriver) createRBD(r *volume.CreateRequest) error {
 	logrus.Infof("volume-rbd Name=%s Request=Create", r.Name)
 
 	d.Lock()
@@ -59,8 +75,16 @@ func (d *rbdDriver) Create(r *volume.CreateRequest) error {
 		Order: 22, // 4KB Objects
 		Mountpoint: "", // Unmounted when ""
 		Device: "",
+		Backend: "rbd",
+		UID: -1,
+		GID: -1,
 	}
 
+	var fromSnapshot string
+	var flatten bool
+	var adopt bool
+	var metadataPool string
+
 	for key, val := range r.Options {
 		switch key {
 		case "pool":
@@ -79,6 +103,59 @@ func (d *rbdDriver) Create(r *volume.CreateRequest) error {
 			v.Order = order
 		case "fstype":
 			v.Fstype = val
+		case "from_snapshot":
+			fromSnapshot = val
+		case "flatten":
+			var flattenOpt, err = strconv.ParseBool(val)
+			if err != nil {
+				return logError("unable to parse flatten bool: %s", err)
+			}
+			flatten = flattenOpt
+		case "backend":
+			// consumed by the top-level dispatcher to pick this backend; nothing to do here.
+		case "uid":
+			var uid, err = strconv.Atoi(val)
+			if err != nil {
+				return logError("unable to parse uid int: %s", err)
+			}
+			v.UID = uid
+		case "gid":
+			var gid, err = strconv.Atoi(val)
+			if err != nil {
+				return logError("unable to parse gid int: %s", err)
+			}
+			v.GID = gid
+		case "mode":
+			if _, err := strconv.ParseUint(val, 8, 32); err != nil {
+				return logError("unable to parse mode as octal: %s", err)
+			}
+			v.Mode = val
+		case "selinux_label":
+			label, shared, err := parseSELinuxLabelOpt(val)
+			if err != nil {
+				return logError("unable to parse selinux_label %q: %s", val, err)
+			}
+			v.SELinuxLabel = label
+			v.SELinuxShared = shared
+		case "no_chown_if_populated":
+			var noChown, err = strconv.ParseBool(val)
+			if err != nil {
+				return logError("unable to parse no_chown_if_populated bool: %s", err)
+			}
+			v.NoChownIfPopulated = noChown
+		case "adopt":
+			var adoptOpt, err = strconv.ParseBool(val)
+			if err != nil {
+				return logError("unable to parse adopt bool: %s", err)
+			}
+			adopt = adoptOpt
+		case "metadata_pool":
+			metadataPool = val
+		case "transport":
+			if val != "krbd" && val != "nbd" {
+				return logError("unknown transport %q: must be \"krbd\" or \"nbd\"", val)
+			}
+			v.Transport = val
 		default:
 			return logError("unknown option %q", val)
 		}
@@ -102,7 +179,45 @@ func (d *rbdDriver) Create(r *volume.CreateRequest) error {
 	}
 
 	if exists {
-		logrus.Warnf("volume-rbd Name=%s Request=Create Message=skipping image create: ceph rbd image exists.", v.Name)
+		logrus.Warnf("volume-rbd Name=%s Request=Create Message=skipping image create: ceph rbd image exists, adopting it.", v.Name)
+
+		if err := d.adoptRbdImage(v, metadataPool); err != nil {
+			return logError("volume-rbd Name=%s Request=Create Message=unable to adopt existing rbd image: %s", v.Name, err)
+		}
+
+	} else if adopt {
+		return logError("volume-rbd Name=%s Request=Create Message=adopt=true but no rbd image named %s exists in pool %s", v.Name, v.Name, v.Pool)
+
+	} else if fromSnapshot != "" {
+		parentImage, parentSnapshot, err := parseSnapshotSpec(fromSnapshot)
+		if err != nil {
+			return logError("volume-rbd Name=%s Request=Create Message=invalid from_snapshot %q: %s", v.Name, fromSnapshot, err)
+		}
+
+		err, protected := d.rbdSnapshotIsProtected(v.Pool, parentImage, parentSnapshot)
+		if err != nil {
+			return logError("volume-rbd Name=%s Request=Create Message=unable to check parent snapshot: %s", v.Name, err)
+		}
+		if !protected {
+			return logError("volume-rbd Name=%s Request=Create Message=parent snapshot %s@%s must be protected before cloning", v.Name, parentImage, parentSnapshot)
+		}
+
+		err = d.cloneRbdImage(v.Pool, parentImage, parentSnapshot, v.Name)
+		if err != nil {
+			return logError("volume-rbd Name=%s Request=Create Message=unable to clone rbd snapshot %s@%s: %s", v.Name, parentImage, parentSnapshot, err)
+		}
+
+		v.ParentImage = parentImage
+		v.ParentSnapshot = parentSnapshot
+
+		err = d.addRbdCloneChild(v.Pool, parentImage, parentSnapshot, v.Name)
+		if err != nil {
+			return logError("volume-rbd Name=%s Request=Create Message=unable to record clone parentage: %s", v.Name, err)
+		}
+
+		if flatten {
+			go d.flattenRbdImageAsync(v.Pool, v.Name)
+		}
 
 	} else {
 		err = d.createRbdImage(v.Pool, v.Name, v.Size, v.Order, v.Fstype)
@@ -137,7 +252,7 @@ func (d *rbdDriver) Create(r *volume.CreateRequest) error {
  *     made available).
  *
  */
-func (d *rbdDriver) List() (*volume.ListResponse, error) {
+func (d *rbdDriver) listRBD() (*volume.ListResponse, error) {
 	logrus.Infof("volume-rbd Request=List")
 
 	d.Lock()
@@ -150,7 +265,7 @@ func (d *rbdDriver) List() (*volume.ListResponse, error) {
 
 	var vols []*volume.Volume
 	for _, v := range *volumes {
-		vols = append(vols, &volume.Volume{Name: v.Name, Mountpoint: v.Mountpoint})
+		vols = append(vols, &volume.Volume{Name: v.Name, Mountpoint: v.Mountpoint, Status: volumeStatus(&v)})
 	}
 	return &volume.ListResponse{Volumes: vols}, nil
 }
@@ -172,7 +287,7 @@ func (d *rbdDriver) List() (*volume.ListResponse, error) {
  *    path on the host filesystem where the volume has been made available,
  *    and/or a string error if an error occurred.
  */
-func (d *rbdDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+func (d *rbdDriver) getRBD(r *volume.GetRequest) (*volume.GetResponse, error) {
 	logrus.Infof("volume-rbd Name=%s Request=Get", r.Name)
 
 	d.Lock()
@@ -187,11 +302,32 @@ func (d *rbdDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
 		return &volume.GetResponse{}, logError("volume-rbd Name=%s Request=Get Message=volume state not found", r.Name)
 	}
 
-	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: v.Mountpoint}}, nil
+	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: v.Mountpoint, Status: volumeStatus(v)}}, nil
+}
+
+// volumeStatus surfaces the snapshot and clone lineage of a volume through
+// the free-form Status map the docker volume API allows, since the
+// volume.Volume type has no dedicated fields for it.
+func volumeStatus(v *Volume) map[string]interface{} {
+	status := map[string]interface{}{}
+	if len(v.Snapshots) > 0 {
+		status["Snapshots"] = v.Snapshots
+	}
+	if len(v.Protected) > 0 {
+		status["ProtectedSnapshots"] = v.Protected
+	}
+	if v.ParentImage != "" {
+		status["ParentImage"] = v.ParentImage
+		status["ParentSnapshot"] = v.ParentSnapshot
+	}
+	if len(v.Children) > 0 {
+		status["Children"] = v.Children
+	}
+	return status
 }
 
 
-func (d *rbdDriver) Remove(r *volume.RemoveRequest) error {
+func (d *rbdDriver) removeRBD(r *volume.RemoveRequest) error {
 	logrus.Infof("volume-rbd Name=%s Request=Create", r.Name)
 
 	d.Lock()
@@ -206,6 +342,10 @@ func (d *rbdDriver) Remove(r *volume.RemoveRequest) error {
 		return logError("volume-rbd Name=%s Request=Remove Message=volume state not found", r.Name)
 	}
 
+	if len(v.Children) > 0 {
+		return logError("volume-rbd Name=%s Request=Remove Message=image has dependent clones %v: flatten or remove them first, or use the admin RemoveForce endpoint with ForceFlattenChildren=true", r.Name, v.Children)
+	}
+
 	err = d.connect(v.Pool)
 	if err != nil {
 		return logError("volume-rbd Name=%s Request=Remove Message=unable to connect to ceph pool: %s", r.Name, err)
@@ -277,7 +417,7 @@ func (d *rbdDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
  *    Respond with the path on the host filesystem where the volume has been
  *    made available, and/or a string error if an error occurred.
  */
-func (d *rbdDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+func (d *rbdDriver) mountRBD(r *volume.MountRequest) (*volume.MountResponse, error) {
 	logrus.Infof("volume-rbd Name=%s Request=Mount", r.Name)
 
 	var err error
@@ -298,11 +438,15 @@ func (d *rbdDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error)
 		logrus.Warnf("volume-rbd Name=%s Request=Mount Message=this volume has a previous registered mountpoint(%s)", v.Name, v.Mountpoint)
 	}
 
-	err, v.Device, v.Mountpoint = d.mountRbdImage(v.Pool, v.Name, v.Fstype)
+	err, v.Device, v.Mountpoint, v.Transport = d.mountRbdImageAnyTransport(v.Pool, v.Name, v.Fstype, v.Transport)
 	if err != nil {
 		return &volume.MountResponse{}, logError("volume-rbd Name=%s Request=Mount Message=unable to mount rbd image: %s", v.Name, err)
 	}
 
+	if err := applyMountOwnership(v); err != nil {
+		return &volume.MountResponse{}, logError("volume-rbd Name=%s Request=Mount Message=unable to apply ownership/labeling: %s", v.Name, err)
+	}
+
 	d.setVolume(v)
 	if err != nil {
 		return &volume.MountResponse{}, logError("volume-rbd Name=%s Request=Mount Message=unable to set volume state: %s", v.Name, err)
@@ -324,7 +468,7 @@ func (d *rbdDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error)
  *    { "Err": null }
  *    Respond with a string error if an error occurred.
  */
-func (d *rbdDriver) Unmount(r *volume.UnmountRequest) error {
+func (d *rbdDriver) unmountRBD(r *volume.UnmountRequest) error {
 	logrus.Infof("volume-rbd Name=%s Request=Unmount", r.Name)
 
 	var err error
@@ -341,7 +485,11 @@ func (d *rbdDriver) Unmount(r *volume.UnmountRequest) error {
 		return logError("volume-rbd Name=%s Request=Unmount Message=volume state not found", r.Name)
 	}
 
-	err = d.freeUpRbdImage(v.Pool, v.Name, v.Mountpoint)
+	if v.Transport == "nbd" {
+		err = d.freeUpRbdImageNbd(v.Pool, v.Name, v.Mountpoint)
+	} else {
+		err = d.freeUpRbdImage(v.Pool, v.Name, v.Mountpoint)
+	}
 	if err != nil {
 		return logError(err.Error())
 	}
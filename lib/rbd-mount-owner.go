@@ -0,0 +1,190 @@
+package dockerVolumeRbd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/*
+ * Ownership/permission/SELinux-label handling for mountRBD. Unlike a
+ * plugin-proxied backend, we own the mountpoint for RBD-backed volumes
+ * directly, so it's safe to chown/chmod/relabel it once mountRbdImage has
+ * made it available - these are applied to the mountpoint root right after
+ * mounting.
+ */
+
+// applyMountOwnership chowns, chmods, and/or relabels v.Mountpoint according
+// to the UID/GID/Mode/SELinuxLabel options recorded on v. Any option left
+// unset (UID/GID == -1, Mode == "", SELinuxLabel == "") is a no-op.
+func applyMountOwnership(v *Volume) error {
+	if v.UID != -1 || v.GID != -1 {
+		skip, err := shouldSkipChown(v)
+		if err != nil {
+			return err
+		}
+		if skip {
+			logrus.Infof("volume-rbd Name=%s Request=Mount Message=mountpoint already populated, skipping chown", v.Name)
+		} else if err := chownMountpoint(v.Mountpoint, v.UID, v.GID); err != nil {
+			return err
+		}
+	}
+
+	if v.Mode != "" {
+		if err := chmodMountpoint(v.Mountpoint, v.Mode); err != nil {
+			return err
+		}
+	}
+
+	if v.SELinuxLabel != "" {
+		if err := relabelMountpoint(v.Mountpoint, v.Name, v.SELinuxLabel, v.SELinuxShared); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shouldSkipChown reports whether the mountpoint already has files in it
+// and v.NoChownIfPopulated asked us to leave existing content's ownership
+// alone.
+func shouldSkipChown(v *Volume) (bool, error) {
+	if !v.NoChownIfPopulated {
+		return false, nil
+	}
+
+	entries, err := ioutil.ReadDir(v.Mountpoint)
+	if err != nil {
+		return false, fmt.Errorf("unable to read mountpoint %s: %s", v.Mountpoint, err)
+	}
+	entries = filterLostAndFound(entries)
+	return len(entries) > 0, nil
+}
+
+// filterLostAndFound drops the lost+found directory mkfs.ext* creates on
+// every new filesystem, so a freshly formatted ext2/3/4 volume still counts
+// as empty for shouldSkipChown.
+func filterLostAndFound(entries []os.FileInfo) []os.FileInfo {
+	filtered := entries[:0]
+	for _, e := range entries {
+		if e.Name() != "lost+found" {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+func chownMountpoint(mountpoint string, uid, gid int) error {
+	logrus.Infof("volume-rbd Request=Chown Mountpoint=%s UID=%d GID=%d", mountpoint, uid, gid)
+
+	if err := os.Chown(mountpoint, uid, gid); err != nil {
+		return fmt.Errorf("unable to chown %s to %d:%d: %s", mountpoint, uid, gid, err)
+	}
+	return nil
+}
+
+func chmodMountpoint(mountpoint, mode string) error {
+	logrus.Infof("volume-rbd Request=Chmod Mountpoint=%s Mode=%s", mountpoint, mode)
+
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("unable to parse mode %q: %s", mode, err)
+	}
+
+	if err := os.Chmod(mountpoint, os.FileMode(parsed)); err != nil {
+		return fmt.Errorf("unable to chmod %s to %s: %s", mountpoint, mode, err)
+	}
+	return nil
+}
+
+// relabelMountpoint applies an SELinux context to the mountpoint, recursing
+// over its contents, using chcon's single-CONTEXT form (never mixed with
+// the -u/-r/-t/-l component flags, which chcon rejects alongside a full
+// context). shared mirrors the docker bind-mount "z"/"Z" suffix convention:
+// true (z) applies label exactly as given so every container using it gets
+// the same context, false (Z) varies the MCS category pair in its level so
+// the mountpoint is only accessible to a context unique to this volume.
+func relabelMountpoint(mountpoint, volumeName, label string, shared bool) error {
+	context := label
+	if !shared {
+		context = privateMCSContext(label, volumeName)
+	}
+
+	logrus.Infof("volume-rbd Request=Relabel Mountpoint=%s Context=%s Shared=%t", mountpoint, context, shared)
+
+	out, err := exec.Command("chcon", "-R", context, mountpoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("chcon -R %s %s failed: %s: %s", context, mountpoint, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// privateMCSContext takes a "user:role:type:level" SELinux context and
+// replaces its level's MCS categories with a pair derived from volumeName,
+// so the resulting context is exclusive to this volume rather than shared
+// by every mount using the bare label (the same effect go-selinux/label
+// gets from its own category allocator, without that dependency here).
+func privateMCSContext(label, volumeName string) string {
+	parts := strings.SplitN(label, ":", 4)
+	if len(parts) != 4 {
+		return label
+	}
+
+	sensitivity := parts[3]
+	if idx := strings.Index(sensitivity, ":"); idx != -1 {
+		sensitivity = sensitivity[:idx]
+	}
+
+	parts[3] = sensitivity + ":" + mcsCategories(volumeName)
+	return strings.Join(parts, ":")
+}
+
+// mcsCategories derives a deterministic pair of MCS categories (e.g.
+// "c45,c892") from name, in the c0-c1023 range SELinux policy reserves for
+// them.
+func mcsCategories(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+
+	c1 := sum % 1024
+	c2 := (sum / 1024) % 1024
+	if c1 == c2 {
+		c2 = (c2 + 1) % 1024
+	}
+
+	return fmt.Sprintf("c%d,c%d", c1, c2)
+}
+
+// parseSELinuxLabelOpt splits a selinux_label option of the form
+// "<context>" or "<context>:z"/":Z" into the context to apply and whether
+// it should be shared (z) or kept private (Z, the default).
+func parseSELinuxLabelOpt(opt string) (string, bool, error) {
+	if opt == "" {
+		return "", false, nil
+	}
+
+	label := opt
+	shared := false
+
+	if idx := strings.LastIndex(opt, ":"); idx != -1 {
+		switch opt[idx+1:] {
+		case "z":
+			label, shared = opt[:idx], true
+		case "Z":
+			label, shared = opt[:idx], false
+		}
+	}
+
+	if label == "" {
+		return "", false, fmt.Errorf("empty SELinux context")
+	}
+
+	return label, shared, nil
+}
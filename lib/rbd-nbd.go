@@ -0,0 +1,137 @@
+package dockerVolumeRbd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// nbdMountBase mirrors the mountpoint convention mountRbdImage uses for
+// krbd-mapped devices, so a volume looks the same to Docker no matter which
+// transport actually backs it.
+const nbdMountBase = "/var/lib/docker-volumes/rbd"
+
+/*
+ * mountRbdImageAnyTransport tries krbd first (or whichever transport was
+ * forced via --opt transport=... or the driver-wide default) and falls back
+ * to rbd-nbd, which maps the image through userspace librbd instead of the
+ * kernel client, whenever krbd's failure looks feature-related.
+ */
+
+// transportKrbd and transportNbd name the two supported mount transports.
+const (
+	transportKrbd = "krbd"
+	transportNbd  = "nbd"
+)
+
+// mountRbdImageAnyTransport mounts image via forcedTransport if set,
+// otherwise via d.defaultTransport (falling back to krbd if that's also
+// unset), automatically retrying with rbd-nbd when krbd refuses to map the
+// image due to unsupported features. A forcedTransport of "krbd" gets no
+// rbd-nbd retry. It returns the transport actually
+// used, which the caller must persist on the Volume so Unmount can match it.
+func (d *rbdDriver) mountRbdImageAnyTransport(pool, image, fstype, forcedTransport string) (error, string, string, string) {
+	transport := forcedTransport
+	if transport == "" {
+		transport = d.defaultTransport
+	}
+	if transport == "" {
+		transport = transportKrbd
+	}
+
+	if transport == transportKrbd {
+		err, device, mountpoint := d.mountRbdImage(pool, image, fstype)
+		if err == nil {
+			return nil, device, mountpoint, transportKrbd
+		}
+
+		if forcedTransport == transportKrbd || !isUnsupportedFeatureError(err) {
+			return err, "", "", ""
+		}
+
+		logrus.Warnf("volume-rbd Name=%s Request=Mount Message=krbd rejected image (likely unsupported features), falling back to rbd-nbd: %s", image, err)
+		transport = transportNbd
+	}
+
+	err, device, mountpoint := d.mountRbdImageNbd(pool, image, fstype)
+	if err != nil {
+		return err, "", "", ""
+	}
+	return nil, device, mountpoint, transportNbd
+}
+
+// isUnsupportedFeatureError reports whether an rbd map failure looks like
+// it was caused by an image feature krbd doesn't understand, as opposed to
+// some other failure (bad pool, permissions, ...) that rbd-nbd won't fix
+// either.
+func isUnsupportedFeatureError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, feature := range []string{"object-map", "fast-diff", "deep-flatten", "journaling", "feature set mismatch", "image uses unsupported features"} {
+		if strings.Contains(msg, feature) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountRbdImageNbd is the rbd-nbd counterpart of mountRbdImage: it maps
+// image through userspace librbd via `rbd-nbd map` instead of the kernel
+// client, then mounts the resulting /dev/nbdN device exactly like the krbd
+// path does.
+func (d *rbdDriver) mountRbdImageNbd(pool, image, fstype string) (error, string, string) {
+	logrus.Infof("volume-rbd Name=%s Request=Mount Transport=nbd", image)
+
+	out, err := exec.Command("rbd-nbd", "map", fmt.Sprintf("%s/%s", pool, image)).Output()
+	if err != nil {
+		return fmt.Errorf("unable to rbd-nbd map %s/%s: %s", pool, image, err), "", ""
+	}
+	device := strings.TrimSpace(string(out))
+
+	mountpoint := filepath.Join(nbdMountBase, image)
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		exec.Command("rbd-nbd", "unmap", device).Run()
+		return fmt.Errorf("unable to create mountpoint %s: %s", mountpoint, err), "", ""
+	}
+
+	if out, err := exec.Command("mount", "-t", fstype, device, mountpoint).CombinedOutput(); err != nil {
+		exec.Command("rbd-nbd", "unmap", device).Run()
+		return fmt.Errorf("unable to mount %s at %s: %s: %s", device, mountpoint, err, strings.TrimSpace(string(out))), "", ""
+	}
+
+	return nil, device, mountpoint
+}
+
+// freeUpRbdImageNbd is the rbd-nbd counterpart of freeUpRbdImage.
+func (d *rbdDriver) freeUpRbdImageNbd(pool, image, mountpoint string) error {
+	logrus.Infof("volume-rbd Name=%s Request=Unmount Transport=nbd", image)
+
+	if out, err := exec.Command("umount", mountpoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to umount %s: %s: %s", mountpoint, err, strings.TrimSpace(string(out)))
+	}
+
+	out, err := exec.Command("rbd-nbd", "list-mapped", "--format=csv").Output()
+	if err != nil {
+		return fmt.Errorf("unable to list rbd-nbd mappings: %s", err)
+	}
+
+	device := ""
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if strings.Contains(line, fmt.Sprintf("%s/%s", pool, image)) {
+			fields := strings.Split(line, ",")
+			device = strings.TrimSpace(fields[len(fields)-1])
+			break
+		}
+	}
+	if device == "" {
+		return fmt.Errorf("no rbd-nbd mapping found for %s/%s", pool, image)
+	}
+
+	if err := exec.Command("rbd-nbd", "unmap", device).Run(); err != nil {
+		return fmt.Errorf("unable to rbd-nbd unmap %s: %s", device, err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package dockerVolumeRbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+/*
+ * pluginProxyBackend forwards VolumeBackend calls to another docker volume
+ * plugin discovered on the host: read its socket under /run/docker/plugins,
+ * then POST the same JSON request shapes the docker volume plugin protocol
+ * itself uses (volume.CreateRequest and friends) over that socket, and
+ * decode the "Err" string every plugin response carries alongside its own
+ * fields.
+ */
+
+const pluginDir = "/run/docker/plugins"
+
+type pluginProxyBackend struct {
+	d          *rbdDriver
+	name       string
+	httpClient *http.Client
+}
+
+// newPluginProxyBackend resolves name to a docker volume plugin listening
+// on /run/docker/plugins/<name>.sock and returns a backend that forwards to
+// it. It does not dial the socket until the first request.
+func newPluginProxyBackend(d *rbdDriver, name string) (*pluginProxyBackend, error) {
+	socketPath := filepath.Join(pluginDir, name+".sock")
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, logError("volume-rbd Backend=%s Message=plugin socket not found at %s: %s", name, socketPath, err)
+	}
+
+	return &pluginProxyBackend{
+		d:    d,
+		name: name,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// call POSTs req to the plugin's handler endpoint (e.g.
+// "VolumeDriver.Create") and decodes its JSON response into resp.
+func (b *pluginProxyBackend) call(method string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return logError("volume-rbd Backend=%s Method=%s Message=unable to marshal request: %s", b.name, method, err)
+	}
+
+	httpResp, err := b.httpClient.Post("http://plugin/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return logError("volume-rbd Backend=%s Method=%s Message=unable to reach plugin: %s", b.name, method, err)
+	}
+	defer httpResp.Body.Close()
+
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return logError("volume-rbd Backend=%s Method=%s Message=unable to decode plugin response: %s", b.name, method, err)
+	}
+	return nil
+}
+
+// Create forwards to the remote plugin and, on success, records a Volume in
+// the local store keyed by name/backend so backendForVolume can route the
+// later Mount/Unmount/Remove/Get calls back to this same backend -
+// createRBD does the equivalent for the built-in "rbd" backend.
+func (b *pluginProxyBackend) Create(r *volume.CreateRequest) error {
+	var resp struct {
+		Err string `json:"Err"`
+	}
+	if err := b.call("VolumeDriver.Create", r, &resp); err != nil {
+		return err
+	}
+	if err := pluginError(resp.Err); err != nil {
+		return err
+	}
+
+	b.d.Lock()
+	defer b.d.Unlock()
+	return b.d.setVolume(&Volume{Name: r.Name, Backend: b.name})
+}
+
+// Remove forwards to the remote plugin and, on success, deletes the local
+// Volume record Create persisted - the mirror image of rbdBackend's
+// removeRBD, which deletes its own volume state after removeRbdImage.
+func (b *pluginProxyBackend) Remove(r *volume.RemoveRequest) error {
+	var resp struct {
+		Err string `json:"Err"`
+	}
+	if err := b.call("VolumeDriver.Remove", r, &resp); err != nil {
+		return err
+	}
+	if err := pluginError(resp.Err); err != nil {
+		return err
+	}
+
+	b.d.Lock()
+	defer b.d.Unlock()
+	return b.d.deleteVolume(r.Name)
+}
+
+// Mount forwards to the remote plugin and persists the mountpoint it
+// reports back onto the local Volume record, the same way mountRBD does
+// for the built-in backend - rbdDriver.Path reads straight out of that
+// shared store and isn't itself part of VolumeBackend.
+func (b *pluginProxyBackend) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	var resp struct {
+		volume.MountResponse
+		Err string `json:"Err"`
+	}
+	if err := b.call("VolumeDriver.Mount", r, &resp); err != nil {
+		return &volume.MountResponse{}, err
+	}
+	if err := pluginError(resp.Err); err != nil {
+		return &volume.MountResponse{}, err
+	}
+
+	if err := b.setVolumeMountpoint(r.Name, resp.Mountpoint); err != nil {
+		return &volume.MountResponse{}, err
+	}
+
+	return &resp.MountResponse, nil
+}
+
+// setVolumeMountpoint updates the Mountpoint on the local Volume record for
+// name, leaving every other field (notably Backend) untouched.
+func (b *pluginProxyBackend) setVolumeMountpoint(name, mountpoint string) error {
+	b.d.Lock()
+	defer b.d.Unlock()
+
+	err, v := b.d.getVolume(name)
+	if err != nil {
+		return err
+	}
+	if v.Name == "" {
+		return logError("volume-rbd Backend=%s Name=%s Message=volume state not found", b.name, name)
+	}
+
+	v.Mountpoint = mountpoint
+	return b.d.setVolume(v)
+}
+
+// Unmount forwards to the remote plugin and, on success, clears the
+// mountpoint Mount recorded, the same way unmountRBD does for the
+// built-in backend.
+func (b *pluginProxyBackend) Unmount(r *volume.UnmountRequest) error {
+	var resp struct {
+		Err string `json:"Err"`
+	}
+	if err := b.call("VolumeDriver.Unmount", r, &resp); err != nil {
+		return err
+	}
+	if err := pluginError(resp.Err); err != nil {
+		return err
+	}
+
+	return b.setVolumeMountpoint(r.Name, "")
+}
+
+func (b *pluginProxyBackend) List() (*volume.ListResponse, error) {
+	var resp struct {
+		volume.ListResponse
+		Err string `json:"Err"`
+	}
+	if err := b.call("VolumeDriver.List", struct{}{}, &resp); err != nil {
+		return &volume.ListResponse{}, err
+	}
+	return &resp.ListResponse, pluginError(resp.Err)
+}
+
+func (b *pluginProxyBackend) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+	var resp struct {
+		volume.GetResponse
+		Err string `json:"Err"`
+	}
+	if err := b.call("VolumeDriver.Get", r, &resp); err != nil {
+		return &volume.GetResponse{}, err
+	}
+	return &resp.GetResponse, pluginError(resp.Err)
+}
+
+// pluginError turns the "Err" string every docker volume plugin response
+// carries into a Go error, matching how docker itself surfaces volume
+// plugin failures.
+func pluginError(errString string) error {
+	if errString == "" {
+		return nil
+	}
+	return errors.New(errString)
+}
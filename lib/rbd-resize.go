@@ -0,0 +1,117 @@
+package dockerVolumeRbd
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/*
+ * Online resize support. The docker volume API has no resize verb, so this
+ * is exposed only through the admin HTTP endpoint (see rbd-admin.go). A
+ * grow just needs `rbd resize` followed by the matching online-grow tool
+ * for whatever's mounted; a shrink has to run the filesystem's offline
+ * shrink tool first, since rbd (like any block device) can't be told to
+ * discard the tail of an image that's still in use by a larger filesystem.
+ */
+
+// resizeVolume grows or shrinks v to newSizeMB and persists the new size on
+// success. A grow runs the matching online-grow tool if the volume is
+// currently mounted; a shrink requires Shrink=true and an unmounted volume,
+// and runs the offline shrink tool before the rbd resize.
+func (d *rbdDriver) resizeVolume(v *Volume, newSizeMB uint64, shrink bool) error {
+	shrinking := newSizeMB < v.Size
+	if shrinking && !shrink {
+		return fmt.Errorf("new size %dMB is smaller than current size %dMB for volume %s: pass Shrink=true to allow", newSizeMB, v.Size, v.Name)
+	}
+
+	if shrinking {
+		if v.Mountpoint != "" {
+			return fmt.Errorf("volume %s must be unmounted before shrinking: resize2fs only shrinks an offline filesystem", v.Name)
+		}
+		if err := d.shrinkFilesystem(v, newSizeMB); err != nil {
+			return fmt.Errorf("unable to shrink filesystem before resize: %s", err)
+		}
+	}
+
+	if err := d.resizeRbdImage(v.Pool, v.Name, newSizeMB, shrinking); err != nil {
+		return err
+	}
+	v.Size = newSizeMB
+
+	if !shrinking && v.Mountpoint != "" {
+		if err := growFilesystem(v); err != nil {
+			return fmt.Errorf("rbd image resized to %dMB but online filesystem grow failed: %s", newSizeMB, err)
+		}
+	}
+
+	return d.setVolume(v)
+}
+
+// resizeRbdImage runs `rbd resize`, passing --allow-shrink when shrinking
+// since rbd refuses to shrink an image otherwise.
+func (d *rbdDriver) resizeRbdImage(pool, image string, newSizeMB uint64, shrink bool) error {
+	logrus.Infof("volume-rbd Name=%s Request=Resize NewSizeMB=%d Shrink=%t", image, newSizeMB, shrink)
+
+	args := []string{"resize", "--size", fmt.Sprintf("%d", newSizeMB), image}
+	if shrink {
+		args = append(args, "--allow-shrink")
+	}
+
+	_, err := d.rbdsh(pool, args...)
+	if err != nil {
+		return fmt.Errorf("unable to resize rbd image %s: %s", image, err)
+	}
+	return nil
+}
+
+// growFilesystem runs the appropriate online-grow tool for v.Fstype against
+// v's mountpoint (or device, for tools that require it).
+func growFilesystem(v *Volume) error {
+	var cmd *exec.Cmd
+
+	switch v.Fstype {
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("resize2fs", v.Device)
+	case "xfs":
+		cmd = exec.Command("xfs_growfs", v.Mountpoint)
+	case "btrfs":
+		cmd = exec.Command("btrfs", "filesystem", "resize", "max", v.Mountpoint)
+	default:
+		return fmt.Errorf("online grow not supported for fstype %q", v.Fstype)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// shrinkFilesystem runs the offline shrink tool for v.Fstype ahead of
+// `rbd resize --allow-shrink`. Only ext2/3/4 support offline shrink; every
+// other fstype refuses the request. v is unmounted at this point (checked
+// by the caller), so v.Device is empty - the image is briefly mapped here
+// just to run resize2fs against it, then unmapped again.
+func (d *rbdDriver) shrinkFilesystem(v *Volume, newSizeMB uint64) error {
+	switch v.Fstype {
+	case "ext2", "ext3", "ext4":
+	default:
+		return fmt.Errorf("offline shrink not supported for fstype %q", v.Fstype)
+	}
+
+	device, err := d.rbdsh(v.Pool, "device", "map", v.Name)
+	if err != nil {
+		return fmt.Errorf("unable to map image for offline shrink: %s", err)
+	}
+	device = strings.TrimSpace(device)
+	defer d.rbdsh(v.Pool, "device", "unmap", device)
+
+	out, err := exec.Command("resize2fs", device, fmt.Sprintf("%dM", newSizeMB)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
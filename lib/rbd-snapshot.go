@@ -0,0 +1,189 @@
+package dockerVolumeRbd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/*
+ * Snapshot and clone support for RBD-backed volumes.
+ *
+ * A volume created with --opt from_snapshot=<image>@<snapshot> is
+ * provisioned as a copy-on-write `rbd clone` of that snapshot rather than a
+ * fresh image. The clone keeps referencing its parent snapshot (which must
+ * therefore stay protected) until it is flattened, either when its parent is
+ * removed through the admin RemoveForce endpoint or in the background when
+ * --opt flatten=true was passed to Create.
+ */
+
+// parseSnapshotSpec splits a "from_snapshot" option of the form
+// "image@snapshot" into its image and snapshot name parts.
+func parseSnapshotSpec(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected \"image@snapshot\", got %q", spec)
+	}
+	return parts[0], parts[1], nil
+}
+
+// createRbdSnapshot creates a snapshot of an existing rbd image.
+func (d *rbdDriver) createRbdSnapshot(pool, image, snapshot string) error {
+	logrus.Infof("volume-rbd Name=%s Request=CreateSnapshot Snapshot=%s", image, snapshot)
+
+	_, err := d.rbdsh(pool, "snap", "create", fmt.Sprintf("%s@%s", image, snapshot))
+	return err
+}
+
+// removeRbdSnapshot removes a (necessarily unprotected) snapshot of an rbd image.
+func (d *rbdDriver) removeRbdSnapshot(pool, image, snapshot string) error {
+	logrus.Infof("volume-rbd Name=%s Request=RemoveSnapshot Snapshot=%s", image, snapshot)
+
+	_, err := d.rbdsh(pool, "snap", "rm", fmt.Sprintf("%s@%s", image, snapshot))
+	return err
+}
+
+// listRbdSnapshots returns the names of every snapshot of the given image.
+func (d *rbdDriver) listRbdSnapshots(pool, image string) (error, []string) {
+	out, err := d.rbdsh(pool, "snap", "ls", "--format=csv", image)
+	if err != nil {
+		return err, nil
+	}
+
+	var snapshots []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, ",", 2)
+		snapshots = append(snapshots, fields[0])
+	}
+	return nil, snapshots
+}
+
+// protectRbdSnapshot protects a snapshot against removal so it can be used
+// as the parent of one or more clones.
+func (d *rbdDriver) protectRbdSnapshot(pool, image, snapshot string) error {
+	logrus.Infof("volume-rbd Name=%s Request=ProtectSnapshot Snapshot=%s", image, snapshot)
+
+	_, err := d.rbdsh(pool, "snap", "protect", fmt.Sprintf("%s@%s", image, snapshot))
+	return err
+}
+
+// unprotectRbdSnapshot reverses protectRbdSnapshot. It fails if clones of
+// the snapshot still exist.
+func (d *rbdDriver) unprotectRbdSnapshot(pool, image, snapshot string) error {
+	logrus.Infof("volume-rbd Name=%s Request=UnprotectSnapshot Snapshot=%s", image, snapshot)
+
+	_, err := d.rbdsh(pool, "snap", "unprotect", fmt.Sprintf("%s@%s", image, snapshot))
+	return err
+}
+
+// rbdSnapshotIsProtected reports whether a snapshot is currently protected.
+func (d *rbdDriver) rbdSnapshotIsProtected(pool, image, snapshot string) (error, bool) {
+	out, err := d.rbdsh(pool, "snap", "ls", "--format=csv", image)
+	if err != nil {
+		return err, false
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) > 0 && fields[0] == snapshot {
+			return nil, strings.Contains(line, "protected")
+		}
+	}
+	return fmt.Errorf("snapshot %s@%s not found", image, snapshot), false
+}
+
+// cloneRbdImage provisions newImage as a copy-on-write clone of a protected
+// parent snapshot.
+func (d *rbdDriver) cloneRbdImage(pool, parentImage, parentSnapshot, newImage string) error {
+	logrus.Infof("volume-rbd Name=%s Request=Clone ParentImage=%s ParentSnapshot=%s", newImage, parentImage, parentSnapshot)
+
+	_, err := d.rbdsh(pool, "clone", fmt.Sprintf("%s@%s", parentImage, parentSnapshot), newImage)
+	return err
+}
+
+// flattenRbdImage detaches a clone from its parent snapshot by copying over
+// all of the parent's data, leaving the image independently removable.
+func (d *rbdDriver) flattenRbdImage(pool, image string) error {
+	logrus.Infof("volume-rbd Name=%s Request=Flatten", image)
+
+	_, err := d.rbdsh(pool, "flatten", image)
+	return err
+}
+
+// flattenRbdImageAsync runs flattenRbdImage in the background (e.g. right
+// after a Create with --opt flatten=true) and updates the volume's stored
+// parentage once it completes.
+func (d *rbdDriver) flattenRbdImageAsync(pool, image string) {
+	err := d.flattenRbdImage(pool, image)
+	if err != nil {
+		logrus.Errorf("volume-rbd Name=%s Request=Flatten Message=background flatten failed: %s", image, err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	err, v := d.getVolume(image)
+	if err != nil || v.Name == "" {
+		logrus.Errorf("volume-rbd Name=%s Request=Flatten Message=unable to reload volume state after flatten: %s", image, err)
+		return
+	}
+
+	err = d.removeRbdCloneChild(pool, v.ParentImage, v.ParentSnapshot, image)
+	if err != nil {
+		logrus.Errorf("volume-rbd Name=%s Request=Flatten Message=unable to detach from parent %s@%s: %s", image, v.ParentImage, v.ParentSnapshot, err)
+	}
+
+	v.ParentImage = ""
+	v.ParentSnapshot = ""
+	if err := d.setVolume(v); err != nil {
+		logrus.Errorf("volume-rbd Name=%s Request=Flatten Message=unable to save volume state: %s", image, err)
+	}
+}
+
+// addRbdCloneChild records childImage as a dependent clone of parentImage on
+// the stored Volume, so Remove can refuse to delete parents with live
+// children and List/Get can surface the lineage.
+func (d *rbdDriver) addRbdCloneChild(pool, parentImage, parentSnapshot, childImage string) error {
+	err, parent := d.getVolume(parentImage)
+	if err != nil {
+		return err
+	}
+	if parent.Name == "" {
+		// Parent isn't one of our managed volumes (e.g. it was removed
+		// after cloning); nothing to record.
+		return nil
+	}
+
+	parent.Children = append(parent.Children, childImage)
+	return d.setVolume(parent)
+}
+
+// removeRbdCloneChild is the inverse of addRbdCloneChild, called once a
+// clone has been flattened and no longer depends on its parent.
+func (d *rbdDriver) removeRbdCloneChild(pool, parentImage, parentSnapshot, childImage string) error {
+	if parentImage == "" {
+		return nil
+	}
+
+	err, parent := d.getVolume(parentImage)
+	if err != nil {
+		return err
+	}
+	if parent.Name == "" {
+		return nil
+	}
+
+	children := parent.Children[:0]
+	for _, c := range parent.Children {
+		if c != childImage {
+			children = append(children, c)
+		}
+	}
+	parent.Children = children
+	return d.setVolume(parent)
+}